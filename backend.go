@@ -0,0 +1,326 @@
+// Copyright 2015 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	gogit "gopkg.in/src-d/go-git.v4"
+	gogitobject "gopkg.in/src-d/go-git.v4/plumbing/object"
+
+	gogitplumbing "gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// Backend selects the implementation Repository uses to satisfy read-only
+// operations such as getCommit, GetRefCommitID, IsCommitExist and tree/blob
+// reads. A repository defaults to BackendExec; call SetBackend to opt a
+// given repository path into BackendGoGit. Writes always go through
+// BackendExec regardless of the selected backend.
+type Backend int
+
+const (
+	// BackendExec forks the `git` binary for every operation. It is the
+	// default and the only backend that supports writes.
+	BackendExec Backend = iota
+	// BackendGoGit serves read-only operations from an in-process
+	// gopkg.in/src-d/go-git.v4 repository handle, avoiding the cost of
+	// forking `git` for commit lookups, ref resolution, tree walks and blob
+	// reads. Writes still go through BackendExec.
+	BackendGoGit
+)
+
+var (
+	backendsMu sync.Mutex
+	backends   = map[string]Backend{} // repoPath -> selected Backend
+
+	gogitReposMu sync.Mutex
+	gogitRepos   = map[string]*gogit.Repository{} // repoPath -> cached handle
+)
+
+// SetBackend selects which Backend repoPath's Repository uses for read-only
+// operations. Passing BackendExec (the zero value) clears any previous
+// selection.
+//
+// The BackendGoGit handle for repoPath is opened once and cached for the
+// life of the process (see gogitRepository). A write made through
+// BackendExec — which is how every write in this package happens,
+// regardless of the selected backend — is not picked up by an
+// already-cached handle, nor is a repository having been deleted and
+// recreated at the same path. Call InvalidateBackendCache(repoPath) after
+// either before relying on a BackendGoGit read to reflect it.
+func SetBackend(repoPath string, backend Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if backend == BackendExec {
+		delete(backends, repoPath)
+		return
+	}
+	backends[repoPath] = backend
+}
+
+// InvalidateBackendCache drops the cached go-git handle for repoPath, if
+// any, so the next BackendGoGit read reopens the repository from disk
+// instead of continuing to serve whatever refs and objects existed when the
+// handle was first cached. Callers with BackendGoGit selected for repoPath
+// must call this after writing to that path by any means (BackendExec or
+// otherwise), and after recreating a repository at a path that previously
+// held one.
+func InvalidateBackendCache(repoPath string) {
+	gogitReposMu.Lock()
+	delete(gogitRepos, repoPath)
+	gogitReposMu.Unlock()
+}
+
+// backend reports the Backend selected for repo via SetBackend, defaulting
+// to BackendExec.
+func (repo *Repository) backend() Backend {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	return backends[repo.Path]
+}
+
+// gogitRepository lazily opens and caches the go-git handle for repo.
+func (repo *Repository) gogitRepository() (*gogit.Repository, error) {
+	gogitReposMu.Lock()
+	defer gogitReposMu.Unlock()
+
+	if r, ok := gogitRepos[repo.Path]; ok {
+		return r, nil
+	}
+
+	r, err := gogit.PlainOpen(repo.Path)
+	if err != nil {
+		return nil, err
+	}
+	gogitRepos[repo.Path] = r
+	return r, nil
+}
+
+// GetCommitViaBackend resolves id to a Commit using whichever backend is
+// selected for repo, without forking `git cat-file` when BackendGoGit is
+// active.
+func (repo *Repository) GetCommitViaBackend(id string) (*Commit, error) {
+	sha, err := NewIDFromString(id)
+	if err != nil {
+		return nil, err
+	}
+	if repo.backend() == BackendGoGit {
+		return repo.getCommitGoGit(sha)
+	}
+	return repo.getCommit(sha)
+}
+
+// GetRefCommitIDViaBackend resolves refName to a commit SHA1 using whichever
+// backend is selected for repo, without forking `git rev-parse` when
+// BackendGoGit is active.
+func (repo *Repository) GetRefCommitIDViaBackend(refName string) (string, error) {
+	if repo.backend() == BackendGoGit {
+		return repo.getRefCommitIDGoGit(refName)
+	}
+	return repo.GetRefCommitID(refName)
+}
+
+// IsCommitExistViaBackend reports whether id names a commit, using whichever
+// backend is selected for repo, without forking `git cat-file -e` when
+// BackendGoGit is active.
+func (repo *Repository) IsCommitExistViaBackend(id string) bool {
+	sha, err := NewIDFromString(id)
+	if err != nil {
+		return false
+	}
+	if repo.backend() == BackendGoGit {
+		return repo.isCommitExistGoGit(sha)
+	}
+	return repo.IsCommitExist(id)
+}
+
+// getCommitGoGit reads the commit object identified by id directly from the
+// go-git object store, without forking `git cat-file`.
+func (repo *Repository) getCommitGoGit(id sha1) (*Commit, error) {
+	r, err := repo.gogitRepository()
+	if err != nil {
+		return nil, err
+	}
+
+	gogitCommit, err := r.CommitObject(gogitHash(id))
+	if err != nil {
+		if err == gogit.ErrObjectNotFound {
+			return nil, ErrNotExist{id.String(), ""}
+		}
+		return nil, err
+	}
+	return repo.commitFromGoGit(gogitCommit)
+}
+
+// getRefCommitIDGoGit resolves refName to a commit SHA1 using the packed and
+// loose refs go-git already has parsed, instead of invoking `git rev-parse`.
+func (repo *Repository) getRefCommitIDGoGit(refName string) (string, error) {
+	r, err := repo.gogitRepository()
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := r.Reference(gogitRefName(refName), true)
+	if err != nil {
+		return "", ErrNotExist{refName, ""}
+	}
+	return ref.Hash().String(), nil
+}
+
+// isCommitExistGoGit reports whether id names a commit object, consulting
+// the cached go-git handle rather than forking `git cat-file -e`.
+func (repo *Repository) isCommitExistGoGit(id sha1) bool {
+	r, err := repo.gogitRepository()
+	if err != nil {
+		return false
+	}
+	_, err = r.CommitObject(gogitHash(id))
+	return err == nil
+}
+
+// ReadBlobViaBackend reads the full contents of the blob at path as of
+// commitID, via the go-git backend, without forking `git show`. It is only
+// meaningful when repo's backend is BackendGoGit.
+func (repo *Repository) ReadBlobViaBackend(commitID, path string) ([]byte, error) {
+	r, err := repo.gogitRepository()
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := r.CommitObject(gogitplumbing.NewHash(commitID))
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	file, err := tree.File(path)
+	if err != nil {
+		return nil, ErrNotExist{commitID, path}
+	}
+
+	rc, err := file.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// WalkTreeViaBackend calls fn once for every blob reachable from the tree at
+// commitID, via the go-git backend, without forking `git ls-tree -r`. It is
+// only meaningful when repo's backend is BackendGoGit.
+func (repo *Repository) WalkTreeViaBackend(commitID string, fn func(path string) error) error {
+	r, err := repo.gogitRepository()
+	if err != nil {
+		return err
+	}
+
+	commit, err := r.CommitObject(gogitplumbing.NewHash(commitID))
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	files := tree.Files()
+	defer files.Close()
+	return files.ForEach(func(f *gogitobject.File) error {
+		return fn(f.Name)
+	})
+}
+
+// gogitHash converts our internal sha1 representation to go-git's plumbing.Hash.
+func gogitHash(id sha1) gogitplumbing.Hash {
+	var h gogitplumbing.Hash
+	copy(h[:], id[:])
+	return h
+}
+
+// gogitRefName converts a short or fully-qualified ref name to the
+// plumbing.ReferenceName go-git expects. A name without the "refs/" prefix
+// is taken as a branch name; short tag names and commit IDs are not
+// recognized.
+func gogitRefName(refName string) gogitplumbing.ReferenceName {
+	if strings.HasPrefix(refName, "refs/") {
+		return gogitplumbing.ReferenceName(refName)
+	}
+	return gogitplumbing.NewBranchReferenceName(refName)
+}
+
+// commitFromGoGit adapts a go-git commit object into our own Commit type so
+// callers of GetCommitViaBackend cannot tell which backend served the lookup.
+func (repo *Repository) commitFromGoGit(c *gogitobject.Commit) (*Commit, error) {
+	var id sha1
+	copy(id[:], c.Hash[:])
+
+	parents := make([]sha1, len(c.ParentHashes))
+	for i, p := range c.ParentHashes {
+		copy(parents[i][:], p[:])
+	}
+
+	treeID, err := NewIDFromString(c.TreeHash.String())
+	if err != nil {
+		return nil, err
+	}
+	tree, err := repo.getTree(treeID)
+	if err != nil {
+		return nil, err
+	}
+
+	commit := &Commit{
+		Tree: *tree,
+		ID:   id,
+		Author: &Signature{
+			Name:  c.Author.Name,
+			Email: c.Author.Email,
+			When:  c.Author.When,
+		},
+		Committer: &Signature{
+			Name:  c.Committer.Name,
+			Email: c.Committer.Email,
+			When:  c.Committer.When,
+		},
+		CommitMessage: c.Message,
+		parents:       parents,
+	}
+
+	// go-git decodes gpgsig into PGPSignature, which strips exactly the
+	// armored block and nothing else; extractSignature wants the raw object
+	// bytes so it can reconstruct the same signed payload `git` itself
+	// verifies against, so re-fetch those instead of using c.PGPSignature.
+	if raw, err := repo.rawObjectGoGit(c.Hash); err == nil {
+		if sig, err := extractSignature(raw); err == nil {
+			commit.Signature = sig
+		}
+	}
+
+	return commit, nil
+}
+
+// rawObjectGoGit returns the raw, undecoded bytes of the object named by
+// hash, via the go-git backend, for callers such as commitFromGoGit that
+// need to see header lines go-git's own decoding discards (like gpgsig).
+func (repo *Repository) rawObjectGoGit(hash gogitplumbing.Hash) ([]byte, error) {
+	r, err := repo.gogitRepository()
+	if err != nil {
+		return nil, err
+	}
+	obj, err := r.Storer.EncodedObject(gogitplumbing.CommitObject, hash)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,317 @@
+// Copyright 2015 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/analysis/tokenizer/unicode"
+	"github.com/blevesearch/bleve/search"
+	"github.com/ethantkoenig/rupture"
+)
+
+// caseSensitiveAnalyzerName indexes Content without the lowercase token
+// filter the default "standard" analyzer applies, so an exact-case phrase
+// query against ContentCS can actually distinguish case instead of matching
+// on lowercased terms either way.
+const caseSensitiveAnalyzerName = "case_sensitive"
+
+// codeIndexerDoc is the document shape stored in the bleve index for a
+// single blob at a given commit. ContentCS duplicates Content under the
+// case-sensitive analyzer so RepoSearchOptions.CaseSensitive queries have a
+// field to run against.
+type codeIndexerDoc struct {
+	RepoPath  string
+	CommitID  string
+	Path      string
+	Language  string
+	Content   string
+	ContentCS string
+}
+
+func (codeIndexerDoc) Type() string {
+	return "code"
+}
+
+// BleveIndexer is an Indexer backed by a bleve index on disk, indexed and
+// queried the same way Gitea indexes repository code (see ethantkoenig/rupture).
+type BleveIndexer struct {
+	indexDir string
+	indexer  bleve.Index
+}
+
+// NewBleveIndexer opens (or creates) a bleve index rooted at indexDir.
+func NewBleveIndexer(indexDir string) (*BleveIndexer, error) {
+	indexer, err := bleve.Open(indexDir)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		mapping, mapErr := buildCodeIndexMapping()
+		if mapErr != nil {
+			return nil, mapErr
+		}
+		indexer, err = bleve.New(indexDir, mapping)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &BleveIndexer{indexDir: indexDir, indexer: indexer}, nil
+}
+
+func buildCodeIndexMapping() (*bleve.IndexMapping, error) {
+	docMapping := bleve.NewDocumentMapping()
+
+	// Path and RepoPath are matched as whole values (exact filename / exact
+	// repo, never "any token in common"), so both get the keyword analyzer.
+	keywordFieldMapping := bleve.NewTextFieldMapping()
+	keywordFieldMapping.Analyzer = keyword.Name
+	docMapping.AddFieldMappingsAt("Path", keywordFieldMapping)
+	docMapping.AddFieldMappingsAt("RepoPath", keywordFieldMapping)
+
+	contentFieldMapping := bleve.NewTextFieldMapping()
+	docMapping.AddFieldMappingsAt("Content", contentFieldMapping)
+
+	mapping := bleve.NewIndexMapping()
+	err := mapping.AddCustomAnalyzer(caseSensitiveAnalyzerName, map[string]interface{}{
+		"type":      custom.Name,
+		"tokenizer": unicode.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	contentCSFieldMapping := bleve.NewTextFieldMapping()
+	contentCSFieldMapping.Analyzer = caseSensitiveAnalyzerName
+	docMapping.AddFieldMappingsAt("ContentCS", contentCSFieldMapping)
+
+	mapping.DefaultMapping = docMapping
+	mapping.DefaultAnalyzer = "standard"
+	return mapping, nil
+}
+
+// Index walks every blob of the tree at commitID and (re)indexes it under
+// repoPath. Each blob is stored under an ID made of repoPath and its path,
+// so re-indexing replaces the document previously stored for that path;
+// documents for paths no longer in the tree are not removed. Indexing a whole tree is exactly the tree-walk-plus-blob-read workload
+// BackendGoGit exists to speed up, so this routes through it whenever it's
+// the selected backend for repoPath.
+func (b *BleveIndexer) Index(repoPath string, commitID string) error {
+	repo, err := OpenRepository(repoPath)
+	if err != nil {
+		return err
+	}
+
+	batch := rupture.NewFlushingBatch(b.indexer, 20)
+	index := func(fullPath string, content []byte) error {
+		if !looksLikeText(content) {
+			return nil
+		}
+		return batch.Index(repoPath+"_"+fullPath, codeIndexerDoc{
+			RepoPath:  repoPath,
+			CommitID:  commitID,
+			Path:      fullPath,
+			Language:  languageFromPath(fullPath),
+			Content:   string(content),
+			ContentCS: string(content),
+		})
+	}
+
+	if repo.backend() == BackendGoGit {
+		err = repo.WalkTreeViaBackend(commitID, func(fullPath string) error {
+			content, err := repo.ReadBlobViaBackend(commitID, fullPath)
+			if err != nil {
+				return err
+			}
+			return index(fullPath, content)
+		})
+		if err != nil {
+			return err
+		}
+		return batch.Flush()
+	}
+
+	commit, err := repo.GetCommit(commitID)
+	if err != nil {
+		return err
+	}
+	entries, err := commit.Tree.ListEntriesRecursive()
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsBlob() {
+			continue
+		}
+
+		dataRc, err := entry.Blob().Data()
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(dataRc)
+		if err != nil {
+			return err
+		}
+		if err := index(entry.Name(), content); err != nil {
+			return err
+		}
+	}
+	return batch.Flush()
+}
+
+// Delete removes every document indexed for repoPath.
+func (b *BleveIndexer) Delete(repoPath string) error {
+	// A term query against the keyword-analyzed RepoPath field matches the
+	// exact repo path only; a MatchQuery would tokenize repoPath and delete
+	// any document sharing a path segment with it.
+	query := bleve.NewTermQuery(repoPath)
+	query.SetField("RepoPath")
+	request := bleve.NewSearchRequest(query)
+	request.Size = 2048
+
+	batch := rupture.NewFlushingBatch(b.indexer, 20)
+	for {
+		result, err := b.indexer.Search(request)
+		if err != nil {
+			return err
+		}
+		if len(result.Hits) == 0 {
+			break
+		}
+		for _, hit := range result.Hits {
+			if err := batch.Delete(hit.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return batch.Flush()
+}
+
+// Search queries the index for opts.Keyword scoped to opts.PathFilters and
+// opts.Language, applying cursor-based paging via opts.Cursor.
+func (b *BleveIndexer) Search(repoPath string, opts *RepoSearchOptions) (*MatchesResults, error) {
+	contentField := "Content"
+	if opts.CaseSensitive {
+		contentField = "ContentCS"
+	}
+
+	var fieldQuery bleve.Query
+	if opts.Regex {
+		regexQuery := bleve.NewRegexpQuery(opts.Keyword)
+		regexQuery.SetField(contentField)
+		fieldQuery = regexQuery
+	} else {
+		// Leave Analyzer unset: bleve resolves the query analyzer from the
+		// target field's own mapping, so this automatically runs through
+		// the lowercasing "standard" analyzer for Content and the
+		// case-preserving "case_sensitive" one for ContentCS.
+		mq := bleve.NewMatchPhraseQuery(opts.Keyword)
+		mq.SetField(contentField)
+		fieldQuery = mq
+	}
+
+	// A term query against the keyword-analyzed RepoPath field matches the
+	// exact repo path only; a MatchQuery would tokenize repoPath and could
+	// pull in results from any other repo sharing a path segment with it.
+	repoQuery := bleve.NewTermQuery(repoPath)
+	repoQuery.SetField("RepoPath")
+
+	conjuncts := []bleve.Query{
+		repoQuery,
+		fieldQuery,
+	}
+	if opts.Language != "" {
+		langQuery := bleve.NewMatchQuery(opts.Language)
+		langQuery.SetField("Language")
+		conjuncts = append(conjuncts, langQuery)
+	}
+	if len(opts.PathFilters) > 0 {
+		pathQueries := make([]bleve.Query, 0, len(opts.PathFilters))
+		for _, pathFilter := range opts.PathFilters {
+			pathQuery := bleve.NewWildcardQuery(pathFilter)
+			pathQuery.SetField("Path")
+			pathQueries = append(pathQueries, pathQuery)
+		}
+		conjuncts = append(conjuncts, bleve.NewDisjunctionQuery(pathQueries...))
+	}
+
+	request := bleve.NewSearchRequest(bleve.NewConjunctionQuery(conjuncts...))
+	request.Fields = []string{"CommitID", "Path", "Language", contentField}
+	request.Highlight = bleve.NewHighlightWithStyle("html")
+	request.IncludeLocations = true
+	request.From = opts.Cursor
+	request.Size = opts.PageSize
+	if request.Size <= 0 {
+		request.Size = 10
+	}
+
+	result, err := b.indexer.Search(request)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := &MatchesResults{NumberMatches: int64(result.Total)}
+	for _, hit := range result.Hits {
+		snippet := ""
+		if fragments, ok := hit.Fragments[contentField]; ok && len(fragments) > 0 {
+			snippet = strings.Join(fragments, "\n")
+		}
+		matches.Results = append(matches.Results, &Match{
+			CommitID:   hit.Fields["CommitID"].(string),
+			Path:       hit.Fields["Path"].(string),
+			Content:    snippet,
+			LineNumber: matchLineNumber(hit, contentField),
+		})
+	}
+	return matches, nil
+}
+
+// matchLineNumber returns the 1-based line within hit's stored contentField
+// that its earliest match starts on, by counting newlines up to the first
+// match location bleve reported. It returns 0 if no location is available
+// for contentField, which shouldn't happen for a hit that matched the
+// conjunction but is tolerated defensively rather than panicking.
+func matchLineNumber(hit *search.DocumentMatch, contentField string) int {
+	termLocations, ok := hit.Locations[contentField]
+	if !ok {
+		return 0
+	}
+
+	start := -1
+	for _, locations := range termLocations {
+		for _, loc := range locations {
+			if start == -1 || int(loc.Start) < start {
+				start = int(loc.Start)
+			}
+		}
+	}
+	if start == -1 {
+		return 0
+	}
+
+	content, ok := hit.Fields[contentField].(string)
+	if !ok {
+		return 0
+	}
+	if start > len(content) {
+		start = len(content)
+	}
+	return strings.Count(content[:start], "\n") + 1
+}
+
+func languageFromPath(path string) string {
+	ext := strings.TrimPrefix(filepath.Ext(path), ".")
+	if ext == "" {
+		return "text"
+	}
+	return ext
+}
+
+func looksLikeText(content []byte) bool {
+	_, isImage := isImageFile(content)
+	return !isImage
+}
@@ -27,6 +27,7 @@ type Commit struct {
 	Author        *Signature
 	Committer     *Signature
 	CommitMessage string
+	Signature     *CommitGPGSignature // set only for a commit with a gpgsig header loaded via GetCommitWithSignature or BackendGoGit; nil otherwise
 
 	parents        []sha1 // SHA1 strings
 	submoduleCache *objectCache
@@ -332,6 +333,12 @@ type CommitsInfo struct {
 	Total int64
 }
 
+// commitsCountPerCollab parses `git log --author | grep | awk` output, which
+// is both injection-prone and locale-dependent (it parses the `Date:` line
+// emitted by `git log`'s default format).
+//
+// Deprecated: use Repository.Contributors, which parses a NUL-delimited
+// `git log` format in Go instead of shelling out to `grep`/`awk`.
 func commitsCountPerCollab(repoPath, user string) (*CommitsInfo, error) {
 	var cmd *Command
 
@@ -376,6 +383,7 @@ func commitsCountPerCollab(repoPath, user string) (*CommitsInfo, error) {
 	return commits, nil
 }
 
+// Deprecated: use Repository.Contributors.
 func (c *Commit) CommitsCountPerCollab(user string) (*CommitsInfo, error) {
 	return commitsCountPerCollab(c.repo.Path, user)
 }
@@ -387,6 +395,11 @@ type StatsUser struct {
 	Files      int
 }
 
+// numStatCommitsPerUser parses `git log --numstat` output with a regular
+// expression, which silently drops malformed rows.
+//
+// Deprecated: use Repository.Contributors, which aggregates insertions and
+// deletions from a NUL-delimited `git log` format instead.
 func numStatCommitsPerUser(user, repoPath string) (*StatsUser, error) {
 	var cmd *Command
 	cmd = NewCommand("log", "--numstat")
@@ -437,6 +450,7 @@ func numStatCommitsPerUser(user, repoPath string) (*StatsUser, error) {
 	return st, err
 }
 
+// Deprecated: use Repository.Contributors.
 func (c *Commit) NumStatCommitsPerUser(user string) (*StatsUser, error) {
 	return numStatCommitsPerUser(user, c.repo.Path)
 }
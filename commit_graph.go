@@ -0,0 +1,382 @@
+// Copyright 2015 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// commitGraphSignature is the 4-byte magic at the start of every
+// commit-graph file ("CGPH").
+var commitGraphSignature = [4]byte{'C', 'G', 'P', 'H'}
+
+// commitGraphNode is one decoded CDAT row, addressable by its position in
+// the OIDL/CDAT chunk (its "graph position").
+type commitGraphNode struct {
+	id             sha1
+	treeID         sha1
+	parent1        int32 // graph position of the 1st parent, or -1
+	parent2        int32 // graph position of the 2nd parent, or -1 (extra parents live in EDGE)
+	extraParents   []int32
+	generation     uint32
+	commitDateUnix int64
+}
+
+// CommitGraph is an in-memory view of `.git/objects/info/commit-graph` (and
+// any chained `commit-graphs/graph-*.graph` split files), used to answer
+// ancestry questions without forking `git`.
+type CommitGraph struct {
+	repo  *Repository
+	nodes []*commitGraphNode
+	byID  map[sha1]int32 // sha1 -> graph position
+}
+
+// CommitGraph loads and decodes the repository's commit-graph file. Callers
+// should treat the result as a point-in-time snapshot: it is not updated as
+// new commits are written, the same way `git commit-graph write` requires an
+// explicit refresh.
+func (repo *Repository) CommitGraph() (*CommitGraph, error) {
+	g := &CommitGraph{repo: repo, byID: map[sha1]int32{}}
+
+	path := filepath.Join(repo.Path, "objects", "info", "commit-graph")
+	if err := g.loadFile(path); err != nil {
+		return nil, err
+	}
+
+	chainPath := filepath.Join(repo.Path, "objects", "info", "commit-graphs", "commit-graph-chain")
+	chain, err := ioutil.ReadFile(chainPath)
+	if err == nil {
+		for _, line := range bytes.Split(bytes.TrimSpace(chain), []byte("\n")) {
+			if len(line) == 0 {
+				continue
+			}
+			splitPath := filepath.Join(repo.Path, "objects", "info", "commit-graphs", "graph-"+string(line)+".graph")
+			if err := g.loadFile(splitPath); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return g, nil
+}
+
+// loadFile decodes a single commit-graph file and appends its commits to g,
+// reading commit IDs from the OIDL chunk and resolving EDGE entries. The
+// OIDF fanout chunk is not consulted.
+func (g *CommitGraph) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) < 8 || !bytes.Equal(data[:4], commitGraphSignature[:]) {
+		return fmt.Errorf("git: not a commit-graph file: %s", path)
+	}
+
+	numChunks := int(data[6])
+	const chunkTableEntrySize = 12
+	chunkTableOffset := 8
+
+	chunks := map[string][2]uint64{}
+	for i := 0; i < numChunks; i++ {
+		entry := data[chunkTableOffset+i*chunkTableEntrySize : chunkTableOffset+(i+1)*chunkTableEntrySize]
+		id := string(entry[:4])
+		offset := binary.BigEndian.Uint64(entry[4:12])
+		nextEntry := data[chunkTableOffset+(i+1)*chunkTableEntrySize : chunkTableOffset+(i+2)*chunkTableEntrySize]
+		nextOffset := binary.BigEndian.Uint64(nextEntry[4:12])
+		chunks[id] = [2]uint64{offset, nextOffset}
+	}
+
+	oidl, ok := chunks["OIDL"]
+	if !ok {
+		return fmt.Errorf("git: commit-graph missing OIDL chunk: %s", path)
+	}
+	cdat, ok := chunks["CDAT"]
+	if !ok {
+		return fmt.Errorf("git: commit-graph missing CDAT chunk: %s", path)
+	}
+	edge := chunks["EDGE"]
+
+	numCommits := int((oidl[1] - oidl[0]) / 20)
+	base := int32(len(g.nodes))
+
+	for i := 0; i < numCommits; i++ {
+		var id sha1
+		copy(id[:], data[int(oidl[0])+i*20:int(oidl[0])+(i+1)*20])
+
+		row := data[int(cdat[0])+i*36 : int(cdat[0])+(i+1)*36]
+		var treeID sha1
+		copy(treeID[:], row[0:20])
+
+		parent1 := binary.BigEndian.Uint32(row[20:24])
+		parent2Raw := binary.BigEndian.Uint32(row[24:28])
+		genAndDate := binary.BigEndian.Uint64(row[28:36])
+
+		node := &commitGraphNode{
+			id:             id,
+			treeID:         treeID,
+			parent1:        resolveParentPos(parent1, base),
+			generation:     uint32(genAndDate >> 34),
+			commitDateUnix: int64(genAndDate & 0x3FFFFFFFF),
+		}
+
+		if parent2Raw&0x80000000 != 0 && edge[1] > edge[0] {
+			// High bit set: parent2Raw is an offset into EDGE, which is a
+			// list of extra parent graph positions terminated by a high-bit
+			// marker on the last entry.
+			node.parent2 = -1
+			offset := int(parent2Raw&0x7FFFFFFF) * 4
+			for {
+				raw := binary.BigEndian.Uint32(data[int(edge[0])+offset : int(edge[0])+offset+4])
+				node.extraParents = append(node.extraParents, resolveParentPos(raw&0x7FFFFFFF, base))
+				offset += 4
+				if raw&0x80000000 != 0 {
+					break
+				}
+			}
+		} else {
+			node.parent2 = resolveParentPos(parent2Raw, base)
+		}
+
+		g.byID[id] = base + int32(i)
+		g.nodes = append(g.nodes, node)
+	}
+
+	return nil
+}
+
+func resolveParentPos(raw uint32, base int32) int32 {
+	const graphParentNone = 0x70000000
+	if raw == graphParentNone {
+		return -1
+	}
+	return base + int32(raw)
+}
+
+func (g *CommitGraph) positionOf(id sha1) (int32, bool) {
+	pos, ok := g.byID[id]
+	return pos, ok
+}
+
+func (g *CommitGraph) parentsOf(pos int32) []int32 {
+	node := g.nodes[pos]
+	parents := []int32{}
+	if node.parent1 >= 0 {
+		parents = append(parents, node.parent1)
+	}
+	if node.parent2 >= 0 {
+		parents = append(parents, node.parent2)
+	}
+	parents = append(parents, node.extraParents...)
+	return parents
+}
+
+// IsAncestor reports whether the commit a is an ancestor of (or equal to) b,
+// walking back from b breadth-first and not expanding the parents of any
+// commit whose generation number is not above a's, since such a commit
+// cannot have a as an ancestor.
+func (g *CommitGraph) IsAncestor(a, b sha1) (bool, error) {
+	aPos, ok := g.positionOf(a)
+	if !ok {
+		return false, ErrNotExist{a.String(), ""}
+	}
+	bPos, ok := g.positionOf(b)
+	if !ok {
+		return false, ErrNotExist{b.String(), ""}
+	}
+	if aPos == bPos {
+		return true, nil
+	}
+
+	aGeneration := g.nodes[aPos].generation
+	visited := map[int32]bool{bPos: true}
+	queue := []int32{bPos}
+	for len(queue) > 0 {
+		pos := queue[0]
+		queue = queue[1:]
+		if pos == aPos {
+			return true, nil
+		}
+		if g.nodes[pos].generation <= aGeneration {
+			continue
+		}
+		for _, parent := range g.parentsOf(pos) {
+			if !visited[parent] {
+				visited[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return false, nil
+}
+
+// MergeBase returns the best common ancestor of a and b, the same commit
+// `git merge-base a b` would report.
+func (g *CommitGraph) MergeBase(a, b sha1) (string, error) {
+	aPos, ok := g.positionOf(a)
+	if !ok {
+		return "", ErrNotExist{a.String(), ""}
+	}
+	bPos, ok := g.positionOf(b)
+	if !ok {
+		return "", ErrNotExist{b.String(), ""}
+	}
+
+	aAncestors := map[int32]bool{}
+	queue := []int32{aPos}
+	for len(queue) > 0 {
+		pos := queue[0]
+		queue = queue[1:]
+		if aAncestors[pos] {
+			continue
+		}
+		aAncestors[pos] = true
+		queue = append(queue, g.parentsOf(pos)...)
+	}
+
+	queue = []int32{bPos}
+	visited := map[int32]bool{}
+	bestGeneration := int64(-1)
+	var best int32 = -1
+	for len(queue) > 0 {
+		pos := queue[0]
+		queue = queue[1:]
+		if visited[pos] {
+			continue
+		}
+		visited[pos] = true
+		if aAncestors[pos] && int64(g.nodes[pos].generation) > bestGeneration {
+			bestGeneration = int64(g.nodes[pos].generation)
+			best = pos
+			continue // no need to look past a common ancestor we've already found
+		}
+		queue = append(queue, g.parentsOf(pos)...)
+	}
+
+	if best == -1 {
+		return "", ErrNotExist{"", ""}
+	}
+	return g.nodes[best].id.String(), nil
+}
+
+// LatestCommitForPath returns the most recent commit, walking back from rev,
+// that last touched path: the first commit (in generation-number order)
+// whose tree entry at path differs from at least one parent's tree entry at path,
+// or the root commit if path was never changed.
+func (g *CommitGraph) LatestCommitForPath(rev, path string) (*Commit, error) {
+	startID, err := g.repo.GetRefCommitIDViaBackend(rev)
+	if err != nil {
+		return nil, err
+	}
+	start, err := NewIDFromString(startID)
+	if err != nil {
+		return nil, err
+	}
+
+	pos, ok := g.positionOf(start)
+	if !ok {
+		return nil, ErrNotExist{rev, ""}
+	}
+
+	// Visit commits in generation-descending order via a max-heap (the same
+	// way `git` and Gitea walk history for this problem), not a FIFO BFS: a
+	// merge's two parents can sit at very different generations, so a plain
+	// queue can visit a lower-generation commit reachable through one parent
+	// before a higher-generation one reachable only through the other,
+	// returning a stale "latest" commit.
+	pq := &genPosHeap{nodes: g.nodes}
+	heap.Push(pq, pos)
+	seen := map[int32]bool{pos: true}
+
+	for pq.Len() > 0 {
+		p := heap.Pop(pq).(int32)
+		node := g.nodes[p]
+		entryID, err := g.treeEntryID(node.treeID, path)
+		if err != nil {
+			return nil, err
+		}
+
+		parents := g.parentsOf(p)
+		if len(parents) == 0 {
+			return g.repo.GetCommitViaBackend(node.id.String())
+		}
+
+		changed := false
+		for _, parentPos := range parents {
+			parentEntryID, err := g.treeEntryID(g.nodes[parentPos].treeID, path)
+			if err != nil {
+				return nil, err
+			}
+			if parentEntryID != entryID {
+				changed = true
+				break
+			}
+		}
+		if changed {
+			return g.repo.GetCommitViaBackend(node.id.String())
+		}
+
+		for _, parent := range parents {
+			if !seen[parent] {
+				seen[parent] = true
+				heap.Push(pq, parent)
+			}
+		}
+	}
+
+	return g.repo.GetCommitViaBackend(g.nodes[pos].id.String())
+}
+
+// genPosHeap is a container/heap.Interface over graph positions, ordered so
+// Pop always returns the remaining position with the highest generation
+// number (a max-heap), the ordering LatestCommitForPath needs to visit
+// history in true generation-descending order.
+type genPosHeap struct {
+	positions []int32
+	nodes     []*commitGraphNode
+}
+
+func (h genPosHeap) Len() int { return len(h.positions) }
+
+func (h genPosHeap) Less(i, j int) bool {
+	return h.nodes[h.positions[i]].generation > h.nodes[h.positions[j]].generation
+}
+
+func (h genPosHeap) Swap(i, j int) {
+	h.positions[i], h.positions[j] = h.positions[j], h.positions[i]
+}
+
+func (h *genPosHeap) Push(x interface{}) {
+	h.positions = append(h.positions, x.(int32))
+}
+
+func (h *genPosHeap) Pop() interface{} {
+	old := h.positions
+	n := len(old)
+	item := old[n-1]
+	h.positions = old[:n-1]
+	return item
+}
+
+// treeEntryID resolves path within the tree rooted at treeID, returning the
+// zero sha1 if the path does not exist in that tree (a deletion).
+func (g *CommitGraph) treeEntryID(treeID sha1, path string) (sha1, error) {
+	tree, err := g.repo.getTree(treeID)
+	if err != nil {
+		return sha1{}, err
+	}
+	entry, err := tree.GetTreeEntryByPath(path)
+	if err != nil {
+		if IsErrNotExist(err) {
+			return sha1{}, nil
+		}
+		return sha1{}, err
+	}
+	return entry.ID, nil
+}
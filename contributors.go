@@ -0,0 +1,182 @@
+// Copyright 2015 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commitHashPattern recognizes a %H token in the NUL-delimited stream so
+// Contributors can tell a record boundary apart from a numstat row without
+// assuming every commit touches the same number of files.
+var commitHashPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// ContributorBucket is the granularity ContributorStatsOptions.Buckets groups
+// commit counts by.
+type ContributorBucket string
+
+const (
+	BucketDay   ContributorBucket = "day"
+	BucketWeek  ContributorBucket = "week"
+	BucketMonth ContributorBucket = "month"
+)
+
+// ContributorStatsOptions configures Repository.Contributors.
+type ContributorStatsOptions struct {
+	Since   string // e.g. "2019-01-01", passed straight to `git log --since`
+	Until   string // e.g. "2019-12-31", passed straight to `git log --until`
+	Path    string // restrict to commits touching this path
+	Author  string // restrict to this author (name, email, or pattern as accepted by `git log --author`)
+	Buckets ContributorBucket
+}
+
+// ContributorStat is one author's aggregated activity.
+type ContributorStat struct {
+	Name       string
+	Email      string
+	Commits    int64
+	Insertions int64
+	Deletions  int64
+	Files      int64 // number of distinct file touches across all commits, not distinct files
+	Series     map[string]int64 // bucket key (e.g. "2019-03-04", "2019-W09", "2019-03") -> commit count
+}
+
+// ContributorStats is the result of Repository.Contributors.
+type ContributorStats struct {
+	TotalCommits int64
+	ByAuthor     map[string]*ContributorStat // keyed by email
+}
+
+const contributorsRecordSep = "\x00"
+
+// Contributors runs `git log --numstat -z` with a NUL-delimited machine
+// format and aggregates the result in Go, replacing the locale-dependent
+// `awk`/`grep` pipelines of commitsCountPerCollab and numStatCommitsPerUser.
+func (repo *Repository) Contributors(opts ContributorStatsOptions) (*ContributorStats, error) {
+	cmd := NewCommand("log", "--numstat", "-z", "--pretty=format:%H%x00%an%x00%ae%x00%aI")
+	if opts.Since != "" {
+		cmd.AddArguments("--since=" + opts.Since)
+	}
+	if opts.Until != "" {
+		cmd.AddArguments("--until=" + opts.Until)
+	}
+	if opts.Author != "" {
+		cmd.AddArguments("--author=" + opts.Author)
+	}
+	if opts.Path != "" {
+		cmd.AddArguments("--", opts.Path)
+	}
+
+	stdout, err := cmd.RunInDir(repo.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &ContributorStats{ByAuthor: map[string]*ContributorStat{}}
+
+	// `-z` NUL-terminates every numstat row in addition to the 3 NULs our own
+	// `--pretty=format:%H%x00%an%x00%ae%x00%aI` inserts, so the number of
+	// tokens per commit varies with how many files it touched. Scan forward
+	// instead of assuming a fixed stride: a %H token is always a bare 40-hex
+	// SHA1, which a numstat row ("<ins>\t<del>\t<path>") never is, so it
+	// reliably marks the start of the next record.
+	//
+	// git also doesn't put a NUL between %aI and the first numstat row: that
+	// boundary is just the pretty-format's own trailing "\n", so tokens[i+3]
+	// is "<date>\n<first numstat row>" (or just "<date>" for a commit that
+	// touched nothing). Split that token on its first newline rather than
+	// discarding whatever follows the date.
+	tokens := strings.Split(stdout, contributorsRecordSep)
+	i := 0
+	for i < len(tokens) {
+		hash := strings.TrimSpace(tokens[i])
+		if !commitHashPattern.MatchString(hash) {
+			i++
+			continue
+		}
+		if i+3 >= len(tokens) {
+			break
+		}
+		name, email := tokens[i+1], tokens[i+2]
+		authorDate, firstRow := splitDateAndFirstRow(tokens[i+3])
+		i += 4
+
+		when, err := time.Parse(time.RFC3339, authorDate)
+		if err != nil {
+			return nil, err
+		}
+
+		stat, ok := stats.ByAuthor[email]
+		if !ok {
+			stat = &ContributorStat{Name: name, Email: email, Series: map[string]int64{}}
+			stats.ByAuthor[email] = stat
+		}
+		stat.Commits++
+		stats.TotalCommits++
+		stat.Series[contributorBucketKey(when, opts.Buckets)]++
+
+		applyNumstatRow(stat, firstRow)
+		for i < len(tokens) && !commitHashPattern.MatchString(strings.TrimSpace(tokens[i])) {
+			applyNumstatRow(stat, strings.Trim(tokens[i], "\n"))
+			i++
+		}
+	}
+
+	return stats, nil
+}
+
+// splitDateAndFirstRow splits the %aI token on its first newline: git
+// doesn't insert a NUL between the pretty-format date and the first numstat
+// row, only a "\n", so anything past that newline is really the first row
+// of the commit's numstat body and must be fed back into the row scanner
+// rather than dropped.
+func splitDateAndFirstRow(token string) (date, firstRow string) {
+	if idx := strings.IndexByte(token, '\n'); idx != -1 {
+		return token[:idx], token[idx+1:]
+	}
+	return token, ""
+}
+
+// applyNumstatRow parses one "<ins>\t<del>\t<path>" numstat row and folds it
+// into stat. Empty or malformed rows (including the ones produced by a
+// commit that touched nothing) are silently ignored.
+func applyNumstatRow(stat *ContributorStat, row string) {
+	if row == "" {
+		return
+	}
+	fields := strings.Fields(row)
+	if len(fields) < 3 {
+		return
+	}
+	ins, _ := strconv.ParseInt(fields[0], 10, 64)
+	del, _ := strconv.ParseInt(fields[1], 10, 64)
+	stat.Insertions += ins
+	stat.Deletions += del
+	stat.Files++
+}
+
+// contributorBucketKey formats when according to bucket, defaulting to
+// per-day buckets ("2006-01-02") when bucket is empty or unrecognized.
+func contributorBucketKey(when time.Time, bucket ContributorBucket) string {
+	switch bucket {
+	case BucketWeek:
+		year, week := when.ISOWeek()
+		return strconv.Itoa(year) + "-W" + pad2(week)
+	case BucketMonth:
+		return when.Format("2006-01")
+	default:
+		return when.Format("2006-01-02")
+	}
+}
+
+func pad2(n int) string {
+	if n < 10 {
+		return "0" + strconv.Itoa(n)
+	}
+	return strconv.Itoa(n)
+}
@@ -0,0 +1,265 @@
+// Copyright 2015 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PushCommit is a single commit as reported in a push event payload.
+type PushCommit struct {
+	ID        string
+	Message   string
+	URL       string
+	Author    *Signature
+	Committer *Signature
+	Added     []string
+	Removed   []string
+	Modified  []string
+}
+
+// PushEvent mirrors the go-gogs-client push event payload shape, so callers
+// that already speak that webhook format can consume it directly.
+type PushEvent struct {
+	RepoPath     string
+	OldRev       string
+	NewRev       string
+	RefName      string
+	Commits      []*PushCommit
+	TotalCommits int
+}
+
+// NewPushHookPayload computes the commits introduced between oldRev and
+// newRev on refName (via `rev-list --reverse oldRev..newRev`, oldest first to
+// match the go-gogs-client push payload shape PushEvent mirrors) and the
+// file-level stats for each, returning a PushEvent ready to hand to a
+// registered hook handler.
+func NewPushHookPayload(repoPath, oldRev, newRev, refName string) (*PushEvent, error) {
+	event := &PushEvent{
+		RepoPath: repoPath,
+		OldRev:   oldRev,
+		NewRev:   newRev,
+		RefName:  refName,
+	}
+
+	// A branch delete or brand new branch has one of the zero SHA1 on either
+	// side; there is nothing to diff.
+	if oldRev == emptySHA1 || newRev == emptySHA1 {
+		return event, nil
+	}
+
+	cmd := NewCommand("rev-list", "--reverse", oldRev+".."+newRev)
+	stdout, err := cmd.RunInDir(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := strings.Fields(stdout)
+	event.TotalCommits = len(ids)
+
+	repo, err := OpenRepository(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		status, err := GetCommitFileStatus(repoPath, id)
+		if err != nil {
+			return nil, err
+		}
+
+		c, err := repo.GetCommit(id)
+		if err != nil {
+			return nil, err
+		}
+
+		event.Commits = append(event.Commits, &PushCommit{
+			ID:        id,
+			Message:   c.Message(),
+			Author:    c.Author,
+			Committer: c.Committer,
+			Added:     status.Added,
+			Removed:   status.Removed,
+			Modified:  status.Modified,
+		})
+	}
+
+	return event, nil
+}
+
+const emptySHA1 = "0000000000000000000000000000000000000000"
+
+// hookHandler is the function events arriving over the Unix socket
+// ListenAndServeHookEvents opens are ultimately delivered to.
+var hookHandler func(*PushEvent) error
+
+// RegisterHookHandler installs the callback ListenAndServeHookEvents
+// delivers PushEvents to. Only one handler can be registered per process;
+// registering again replaces the previous handler.
+func RegisterHookHandler(handler func(*PushEvent) error) {
+	hookHandler = handler
+}
+
+// DispatchPushEvent runs the handler registered with RegisterHookHandler, if
+// any.
+func DispatchPushEvent(event *PushEvent) error {
+	if hookHandler == nil {
+		return nil
+	}
+	return hookHandler(event)
+}
+
+// ListenAndServeHookEvents opens a Unix domain socket at socketPath and, for
+// every connection, decodes one JSON-encoded PushEvent and passes it to
+// DispatchPushEvent. This is the server side of the bridge the post-receive
+// hook needs: the hook itself always runs as a process `git` spawns fresh
+// for every push, with no way to call back into the already running
+// server's address space, so the hook process (via RunHookCLI) instead
+// connects to this socket and hands its event over as bytes. The returned
+// listener must be closed to stop serving; closing it does not wait for
+// in-flight connections to finish.
+func ListenAndServeHookEvents(socketPath string) (io.Closer, error) {
+	_ = os.Remove(socketPath) // stale socket from a previous, killed server
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("git: listen on hook socket %q: %v", socketPath, err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return // listener closed
+			}
+			go serveHookConn(conn)
+		}
+	}()
+
+	return listener, nil
+}
+
+func serveHookConn(conn net.Conn) {
+	defer conn.Close()
+	var event PushEvent
+	if err := json.NewDecoder(conn).Decode(&event); err != nil {
+		return
+	}
+	DispatchPushEvent(&event)
+}
+
+// SendHookEvent dials socketPath and writes event to it as JSON, for the
+// client side of the same bridge: a process spawned by `git` to run a hook
+// has no way to call DispatchPushEvent directly, since that runs in the
+// server's address space, not its own.
+func SendHookEvent(socketPath string, event *PushEvent) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("git: dial hook socket %q: %v", socketPath, err)
+	}
+	defer conn.Close()
+	return json.NewEncoder(conn).Encode(event)
+}
+
+// RunHookCLI implements the body of a post-receive hook: it reads the
+// `<old-rev> <new-rev> <ref-name>` lines git feeds the hook on stdin, builds
+// a PushEvent for each with NewPushHookPayload, and delivers it to
+// socketPath via SendHookEvent. A caller wires this up by building a tiny
+// helper binary (or subcommand of their own binary) that does nothing but
+// call RunHookCLI with os.Stdin, repoPath and the socket path
+// ListenAndServeHookEvents was given; InstallHooks writes the post-receive
+// script that execs it.
+func RunHookCLI(stdin io.Reader, repoPath, socketPath string) error {
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		oldRev, newRev, refName := fields[0], fields[1], fields[2]
+
+		event, err := NewPushHookPayload(repoPath, oldRev, newRev, refName)
+		if err != nil {
+			return err
+		}
+		if err := SendHookEvent(socketPath, event); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+const hookFileMode = 0755
+
+// hookMarker tags every script InstallHooks writes, so a later InstallHooks
+// call can recognize and remove one of its own leftover scripts (such as the
+// pre-receive and update scripts an older version of this package installed
+// alongside post-receive) without touching a hook file it didn't write.
+const hookMarker = "# git-module: managed hook, see InstallHooks"
+
+// hookScriptFormat is the shell body written for post-receive: it forwards
+// git's own stdin (the `old new ref` lines, one per updated ref, each
+// already the batch RunHookCLI wants) to helperBinary, which is expected to
+// call RunHookCLI with repoPath and socketPath baked in as its arguments.
+//
+// pre-receive gets the identical stdin batch, so installing the same script
+// there too would dispatch every PushEvent twice; update runs once per ref
+// with `refname old new` as argv and effectively nothing useful on stdin, so
+// it can't run this script at all. post-receive is therefore the only hook
+// RunHookCLI's protocol actually fits, and the only one InstallHooks writes.
+const hookScriptFormat = "#!/bin/sh\n" + hookMarker + "\nexec %s %s %s\n"
+
+// InstallHooks writes a post-receive script into dir (typically repo.Path +
+// "/hooks") that execs helperBinary repoPath socketPath and feeds it git's
+// own hook stdin. helperBinary is the caller's small wrapper that calls
+// RunHookCLI; socketPath is the address ListenAndServeHookEvents is
+// listening on in the long-running server process. Any existing
+// post-receive hook is overwritten.
+//
+// It also removes any pre-receive or update script left behind by an older
+// version of this package that, unlike the current one, installed the same
+// RunHookCLI-invoking script under all three hook names — left in place,
+// such a script would keep dispatching every PushEvent a second (or third)
+// time. Only scripts carrying hookMarker are removed; a hook file without it
+// was not written by InstallHooks and is left alone.
+func (repo *Repository) InstallHooks(dir, helperBinary, socketPath string) error {
+	for _, name := range []string{"pre-receive", "update"} {
+		path := filepath.Join(dir, name)
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue // nothing to clean up
+		}
+		if !strings.Contains(string(contents), hookMarker) {
+			continue // not ours to remove
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("git: remove stale hook %q: %v", name, err)
+		}
+	}
+
+	body := fmt.Sprintf(hookScriptFormat, shellQuote(helperBinary), shellQuote(repo.Path), shellQuote(socketPath))
+
+	path := filepath.Join(dir, "post-receive")
+	if err := ioutil.WriteFile(path, []byte(body), hookFileMode); err != nil {
+		return fmt.Errorf("git: write hook %q: %v", "post-receive", err)
+	}
+	return nil
+}
+
+// shellQuote wraps s in single quotes for safe use as one word in a POSIX
+// `sh` script, escaping any single quote in s by closing the quoted string,
+// emitting an escaped quote, and reopening it — the standard way to embed an
+// arbitrary string (repo.Path included) in `sh` without word-splitting or
+// letting shell metacharacters in it take effect.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,18 @@
+// Copyright 2015 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package git
+
+// Indexer indexes the blobs of a repository so that code search does not
+// need to shell out to `git grep` for every query. Implementations are
+// expected to be safe for concurrent use.
+type Indexer interface {
+	// Index adds or updates the searchable content for the given commit.
+	Index(repoPath string, commitID string) error
+	// Delete removes all indexed content belonging to repoPath.
+	Delete(repoPath string) error
+	// Search runs opts against the index and returns a page of matches, each
+	// carrying its file path, commit ID and line number.
+	Search(repoPath string, opts *RepoSearchOptions) (*MatchesResults, error)
+}
@@ -6,79 +6,171 @@ package git
 
 import (
 	"bufio"
-	//"fmt"
 	"strings"
-	//"strconv"
 )
 
-
-
 type Match struct {
-	CommitID 	string
-	Path 		string
-	Content 	string
+	CommitID   string
+	Path       string
+	Content    string
+	LineNumber int // 1-based line within the file at Path that the match starts on; 0 if unknown (e.g. the git-grep fallback already embeds it in Content)
 }
 
 type MatchesResults struct {
 	NumberMatches int64
-	Results 	[]* Match
+	Results       []*Match
 }
 
 type RepoSearchOptions struct {
-	Keyword  string
-	OwnerID  int64
-	OrderBy  string
-	Page     int
-	PageSize int // Can be smaller than or equal to setting.ExplorePagingNum
+	Keyword       string
+	OwnerID       int64
+	OrderBy       string
+	Page          int
+	PageSize      int      // Can be smaller than or equal to setting.ExplorePagingNum
+	Regex         bool     // Treat Keyword as a regular expression instead of a fixed string
+	CaseSensitive bool     // Match Keyword case-sensitively
+	PathFilters   []string // Restrict matches to paths matching any of these globs
+	Language      string   // Restrict matches to blobs detected as this language
+	Cursor        int      // Offset into the result set used with PageSize by the Indexer path, which ignores Page; the git grep fallback ignores Cursor
+}
+
+// revList returns every commit reachable from any ref, one SHA1 per line. It
+// returns an empty slice (not a slice holding one empty string) for a
+// repository with no commits.
+func revList(repoPath, orderBy string) ([]string, error) {
+	cmd := NewCommand("rev-list", "--all")
+	if orderBy != "" {
+		cmd.AddArguments(orderBy)
+	}
+	stdout, err := cmd.RunInDir(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	stdout = strings.TrimSpace(stdout)
+	if stdout == "" {
+		return nil, nil
+	}
+	return strings.Split(stdout, "\n"), nil
 }
 
+// revBatchSize bounds how many revisions are placed on a single `git grep`
+// command line, so that a large history doesn't hit the OS argument-length
+// limit the way a single `git grep $(all revs)` invocation would.
+const revBatchSize = 500
+
+// runGrepAcrossRevs runs `git grep` once per batch of up to revBatchSize
+// revs (the same thing `rev-list --all | xargs git grep` did, without
+// shelling out through a pipe), concatenating the matching output across
+// batches. prefixArgs holds the grep flags and pattern; suffixArgs holds the
+// trailing `-- <pathspec>...`, which must follow the tree-ish list in each
+// invocation.
+func runGrepAcrossRevs(repoPath string, revs []string, prefixArgs, suffixArgs []string) (string, error) {
+	if len(revs) == 0 {
+		return "", nil
+	}
 
-//get number of matches from code search
-func getNumberOfCodeMatches(repoPath, keyword string) (int64, error){
-	var cmd *Command
-	cmd = NewCommand("rev-list", "--all", "| xargs git grep -F -c -I '" + keyword + "'" )
-	
-	stdout, err := cmd.RunPipesInDir(repoPath)
+	var out strings.Builder
+	for start := 0; start < len(revs); start += revBatchSize {
+		end := start + revBatchSize
+		if end > len(revs) {
+			end = len(revs)
+		}
+
+		cmd := NewCommand("grep")
+		cmd.AddArguments(prefixArgs...)
+		cmd.AddArguments(revs[start:end]...)
+		cmd.AddArguments(suffixArgs...)
+
+		stdout, err := cmd.RunInDir(repoPath)
+		if err != nil {
+			// Exit status 1 just means "no match in this batch"; git grep
+			// only exits with other statuses on a real error.
+			if err.Error() == "exit status 1" {
+				continue
+			}
+			return "", err
+		}
+		out.WriteString(stdout)
+	}
+	return out.String(), nil
+}
+
+// getNumberOfCodeMatches shells out to `git grep` across every commit reachable
+// from any ref. It is kept only as a fallback for repositories that have not
+// been indexed yet; Repository.SearchCode should be preferred. The keyword is
+// always passed as a discrete command argument, never concatenated into a
+// shell string, so it cannot be used to inject additional commands.
+func getNumberOfCodeMatches(repoPath, keyword string) (int64, error) {
+	revs, err := revList(repoPath, "")
+	if err != nil {
+		return 0, err
+	}
+
+	stdout, err := runGrepAcrossRevs(repoPath, revs, []string{"-F", "-c", "-I", "-e", keyword}, nil)
+	if err != nil {
+		return 0, err
+	}
 	if len(stdout) <= 0 {
 		return 0, nil
 	}
 
-	return int64(len(strings.Split(stdout, "\n")) - 1), err
+	return int64(strings.Count(stdout, "\n")), nil
 }
 
 func (repo *Repository) GetNumberOfCodeMatches(keyword string) (int64, error) {
 	return getNumberOfCodeMatches(repo.Path, keyword)
 }
 
-func getRangeOfMatches(repoPath string, opts *RepoSearchOptions) ([]* Match, error){
+// getRangeOfMatches shells out to `git grep` the same way getNumberOfCodeMatches
+// does: the keyword and every revision are passed as discrete arguments, never
+// interpolated into a shell pipeline. It is the fallback path used when no
+// Indexer is available for the repository.
+func getRangeOfMatches(repoPath string, opts *RepoSearchOptions) ([]*Match, error) {
 	var (
-		cmd *Command
-		matches []* Match
-		info []string
-		stdout string
-		err error
+		matches []*Match
+		info    []string
 	)
 
-	//fmt.Println("%+v", opts)
-	cmd = NewCommand("rev-list", "--all", opts.OrderBy, "| xargs git grep -F -I -i -n --no-color --full-name --break --heading -B 2 -A 2 '" + opts.Keyword + "'")
-	
-	stdout, err = cmd.RunPipesInDir(repoPath)
+	revs, err := revList(repoPath, opts.OrderBy)
+	if err != nil {
+		return nil, err
+	}
+
+	matchFlag := "-F"
+	if opts.Regex {
+		matchFlag = "-E"
+	}
+	prefixArgs := []string{matchFlag, "-I", "-n", "--no-color", "--full-name", "--break", "--heading", "-B", "2", "-A", "2"}
+	if !opts.CaseSensitive {
+		prefixArgs = append(prefixArgs, "-i")
+	}
+	prefixArgs = append(prefixArgs, "-e", opts.Keyword)
+
+	var suffixArgs []string
+	if len(opts.PathFilters) > 0 {
+		suffixArgs = append(suffixArgs, "--")
+		suffixArgs = append(suffixArgs, opts.PathFilters...)
+	}
 
+	stdout, err := runGrepAcrossRevs(repoPath, revs, prefixArgs, suffixArgs)
+	if err != nil {
+		return nil, err
+	}
 	if len(stdout) <= 0 {
 		return nil, nil
 	}
 	results := strings.Split(stdout, "\n\n")
 
 	var limit int64
-	if (opts.Page * opts.PageSize) < len(results){
+	if (opts.Page * opts.PageSize) < len(results) {
 		limit = int64(opts.Page * opts.PageSize)
 	} else {
 		limit = int64(len(results))
 	}
 
-	results = results[(opts.Page - 1) * opts.PageSize : limit]
+	results = results[(opts.Page-1)*opts.PageSize : limit]
 
-	for _, result := range  results {
+	for _, result := range results {
 		scanner := bufio.NewReader(strings.NewReader(result))
 		header, err := scanner.ReadString('\n')
 		if err != nil {
@@ -89,22 +181,19 @@ func getRangeOfMatches(repoPath string, opts *RepoSearchOptions) ([]* Match, err
 
 		matches = append(matches, &Match{
 			CommitID: info[0],
-			Path: strings.Trim(info[1]," "),
-			Content: result,
-		})	
+			Path:     strings.Trim(info[1], " "),
+			Content:  result,
+		})
 	}
 	return matches, err
 }
 
-
-func (repo *Repository) GetRangeOfMatches(opts *RepoSearchOptions) ([]* Match, error) {
+func (repo *Repository) GetRangeOfMatches(opts *RepoSearchOptions) ([]*Match, error) {
 	return getRangeOfMatches(repo.Path, opts)
 }
 
-
-
 func (repo *Repository) ShearchMatchesThisRepo(opts *RepoSearchOptions) (matches *MatchesResults, _ error) {
-	
+
 	var err error
 	matches = new(MatchesResults)
 
@@ -119,4 +208,25 @@ func (repo *Repository) ShearchMatchesThisRepo(opts *RepoSearchOptions) (matches
 	}
 
 	return matches, nil
-}
\ No newline at end of file
+}
+
+// codeIndexer is set by SetRepositoryIndexer; nil means no index is available and
+// SearchCode falls back to shelling out to `git grep`.
+var codeIndexer Indexer
+
+// SetRepositoryIndexer installs the Indexer used by Repository.SearchCode.
+// Passing nil restores the `git grep` fallback path.
+func SetRepositoryIndexer(indexer Indexer) {
+	codeIndexer = indexer
+}
+
+// SearchCode returns matches for opts, using the installed Indexer (which
+// returns highlighted snippets) when one is available and falling back to
+// the `git grep` based implementation (which returns raw grep context)
+// otherwise.
+func (repo *Repository) SearchCode(opts *RepoSearchOptions) (*MatchesResults, error) {
+	if codeIndexer != nil {
+		return codeIndexer.Search(repo.Path, opts)
+	}
+	return repo.ShearchMatchesThisRepo(opts)
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package git
+
+import (
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// tagSignatures holds signatures parsed by LoadTagSignature, keyed by tag
+// ID, until Verify consumes them. Annotated-tag parsing (wherever *Tag is
+// actually built from a raw tag object) lives outside this series, so there
+// is no field on *Tag to populate the way Commit.Signature is populated —
+// this map is a stand-in, not a drop-in equivalent, the same limitation
+// backend.go's path-keyed maps have for *Repository. Verify deletes an entry
+// the moment it reads it so a LoadTagSignature call that's never followed by
+// Verify doesn't leak for the life of the process.
+var (
+	tagSignaturesMu sync.Mutex
+	tagSignatures   = map[string]*CommitGPGSignature{}
+)
+
+// LoadTagSignature fetches the raw annotated tag object named by id and, if
+// it carries a gpgsig header, records the parsed signature so the next call
+// to t.Verify (for a Tag whose ID is id) can succeed. Callers must call this
+// shortly before Verify, not once at load time for a tag they'll verify
+// later: the record is consumed (deleted) on the first Verify call for id,
+// by design, to keep this bounded to tags actually in the middle of being
+// verified rather than every tag ever loaded.
+func (repo *Repository) LoadTagSignature(id string) error {
+	raw, err := repo.getRawObject(id)
+	if err != nil {
+		return err
+	}
+	sig, err := extractSignature(raw)
+	if err != nil {
+		return err
+	}
+
+	tagSignaturesMu.Lock()
+	tagSignatures[id] = sig
+	tagSignaturesMu.Unlock()
+	return nil
+}
+
+// Verify checks the signature LoadTagSignature recorded for t.ID against
+// keyring, returning the entity whose key produced it. The recorded
+// signature is consumed on read, so calling Verify twice for the same tag
+// requires calling LoadTagSignature again in between. It reports an error if
+// no signature was recorded for t.ID (either the tag isn't signed, or
+// LoadTagSignature was never called for it) or the signature does not
+// verify.
+func (t *Tag) Verify(keyring openpgp.KeyRing) (*openpgp.Entity, error) {
+	id := t.ID.String()
+
+	tagSignaturesMu.Lock()
+	sig, ok := tagSignatures[id]
+	if ok {
+		delete(tagSignatures, id)
+	}
+	tagSignaturesMu.Unlock()
+
+	if !ok {
+		return nil, ErrNotExist{id, gpgSignatureHeader}
+	}
+
+	return openpgp.CheckArmoredDetachedSignature(
+		keyring,
+		strings.NewReader(sig.Payload),
+		strings.NewReader(sig.Signature),
+	)
+}